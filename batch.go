@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// BatchInterceptFunc is the batched counterpart to InterceptFunc. It receives
+// an accumulated batch of up to Scaler.BatchSize values and returns the
+// values to emit along with whether they should be sent to out.
+type BatchInterceptFunc[T, U any] func(ctx context.Context, batch []T) ([]U, bool)
+
+// layer2Batch is the batching counterpart to layer2, used when
+// s.BatchInterceptFunc is set. Instead of invoking Fn once per item, it
+// accumulates incoming values into a batch of up to s.BatchSize items,
+// flushing whenever the batch is full or s.BatchWait has elapsed since the
+// first item in the batch arrived, then invokes s.BatchInterceptFunc once
+// for the whole batch and streams the results to out. This lets callers
+// amortize expensive per-call costs (DB writes, HTTP posts, model inference)
+// while retaining the Scaler's auto-scaling semantics. layer2Batch has the
+// same life time semantics as layer2.
+func (s Scaler[T, U]) layer2Batch(ctx context.Context, in <-chan staged[T], limiter *rate.Limiter) <-chan U {
+	out := make(chan U)
+
+	batchSize := s.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	go func() {
+		defer s.protect()
+		defer close(out)
+		defer s.Observer.retire()
+
+		timer := time.NewTimer(s.Life)
+		defer timer.Stop()
+
+		// batchTimer tracks BatchWait for the current batch. It starts
+		// stopped and is only armed once the first item of a new batch
+		// arrives.
+		batchTimer := time.NewTimer(s.BatchWait)
+		if !batchTimer.Stop() {
+			<-batchTimer.C
+		}
+		batchTimerArmed := false
+		defer batchTimer.Stop()
+
+		batch := make([]staged[T], 0, batchSize)
+
+		flush := func() {
+			if batchTimerArmed {
+				if !batchTimer.Stop() {
+					<-batchTimer.C
+				}
+				batchTimerArmed = false
+			}
+
+			if len(batch) == 0 {
+				return
+			}
+
+			if limiter != nil && !limiter.Allow() {
+				s.backpressure()
+
+				if err := limiter.Wait(ctx); err != nil {
+					return
+				}
+			}
+
+			values := make([]T, len(batch))
+			for i, st := range batch {
+				values[i] = st.value
+			}
+
+			start := time.Now()
+			us, send := s.BatchInterceptFunc(ctx, values)
+			s.recordItem(time.Since(start), send)
+
+			if !send {
+				// The batch was still fully processed by BatchInterceptFunc,
+				// just not emitted: ack every staged item in it so
+				// Checkpoint doesn't replay it forever.
+				for _, st := range batch {
+					s.ack(ctx, st)
+				}
+				batch = batch[:0]
+				return
+			}
+
+			for _, u := range us {
+				select {
+				case <-ctx.Done():
+					return
+				case out <- u:
+				}
+			}
+
+			// The whole batch was handed off successfully; ack every
+			// staged item in it now that it has been delivered.
+			for _, st := range batch {
+				s.ack(ctx, st)
+			}
+			batch = batch[:0]
+		}
+
+	batchLoop:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				break batchLoop
+			case <-batchTimer.C:
+				batchTimerArmed = false
+				flush()
+			case st, ok := <-in:
+				if !ok {
+					break batchLoop
+				}
+
+				batch = append(batch, st)
+
+				if len(batch) == 1 {
+					batchTimer.Reset(s.BatchWait)
+					batchTimerArmed = true
+				}
+
+				if len(batch) >= batchSize {
+					flush()
+				}
+			}
+
+			// NOTE: This code is based off the doc comment for time.Timer.Stop
+			// which ensures that the channel of the timer is drained before
+			// resetting the timer so that it doesn't immediately trip the
+			// case statement.
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(s.Life)
+		}
+
+		flush()
+	}()
+
+	return out
+}
@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScalerExecBatches(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches [][]int
+	)
+
+	s := Scaler[int, int]{
+		Wait:        time.Millisecond,
+		Life:        100 * time.Millisecond,
+		MaxRoutines: 1, // force a single worker so the batch isn't split
+		BatchSize:   3,
+		BatchWait:   50 * time.Millisecond,
+		BatchInterceptFunc: func(_ context.Context, batch []int) ([]int, bool) {
+			cp := append([]int(nil), batch...)
+
+			mu.Lock()
+			batches = append(batches, cp)
+			mu.Unlock()
+
+			us := make([]int, len(batch))
+			for i, v := range batch {
+				us[i] = v * 2
+			}
+
+			return us, true
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan int)
+	out, err := s.Exec(ctx, in)
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	values := []int{1, 2, 3, 4, 5}
+
+	go func() {
+		for _, v := range values {
+			in <- v
+		}
+	}()
+
+	got := make(map[int]bool, len(values))
+	for i := range values {
+		select {
+		case v := <-out:
+			got[v] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for output %d", i)
+		}
+	}
+
+	for _, v := range values {
+		if !got[v*2] {
+			t.Fatalf("missing doubled output %d in %v", v*2, got)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(batches) == 0 {
+		t.Fatal("BatchInterceptFunc was never called")
+	}
+
+	multiItem := false
+
+	for _, b := range batches {
+		if len(b) > s.BatchSize {
+			t.Fatalf("batch %v has more than BatchSize (%d) items", b, s.BatchSize)
+		}
+
+		if len(b) > 1 {
+			multiItem = true
+		}
+	}
+
+	if !multiItem {
+		t.Fatalf("BatchInterceptFunc was never called with more than one item, want at least one batch: %v", batches)
+	}
+}
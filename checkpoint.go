@@ -0,0 +1,285 @@
+package stream
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Checkpointer lets a Scaler persist items as they enter the pipeline so
+// that an in-flight item is not silently lost if the context is canceled or
+// Fn panics before the item is delivered to out.
+//
+// Stage is called once per item, before it is handed to a layer2 routine,
+// and returns a token identifying the staged item. Ack is called once the
+// item has been fully processed (Fn, or BatchInterceptFunc for the item's
+// batch, returned send=true and the value was delivered to out, or returned
+// send=false so there is nothing to deliver) and tells the Checkpointer it
+// may forget the item. Recover is called once, when Exec
+// starts, and returns any items that were staged but never acked, for
+// example because of a prior crash, each paired with the token it was
+// originally staged with: Exec acks that same token directly once the
+// recovered item is delivered, rather than staging it again under a new one.
+type Checkpointer[T any] interface {
+	Stage(ctx context.Context, t T) (token any, err error)
+	Ack(ctx context.Context, token any) error
+	Recover(ctx context.Context) (<-chan Recovered[T], error)
+}
+
+// Recovered is one item returned by Checkpointer.Recover, paired with the
+// token it was originally staged with.
+type Recovered[T any] struct {
+	Value T
+	Token any
+}
+
+// staged pairs a value read from in with the token (if any) returned by
+// staging it with a Checkpointer, and, when Scaler.PreserveOrder is set, the
+// sequence number assigned to it by Exec. token is nil when no Checkpointer
+// is configured, or when staging it failed. seq is unused when PreserveOrder
+// is false.
+type staged[T any] struct {
+	value T
+	token any
+	seq   uint64
+}
+
+// ack reports the staged item as processed to Checkpoint, if both a
+// Checkpointer and a token are present.
+func (s Scaler[T, U]) ack(ctx context.Context, st staged[T]) {
+	s.ackToken(ctx, st.token)
+}
+
+// ackToken is the token-only counterpart to ack, used by the reorder stage,
+// which only carries a token forward (not a full staged[T]) once an item has
+// left layer2.
+func (s Scaler[T, U]) ackToken(ctx context.Context, token any) {
+	if s.Checkpoint != nil && token != nil {
+		_ = s.Checkpoint.Ack(ctx, token)
+	}
+}
+
+// stage stages v with Checkpoint, if configured, falling back to processing
+// v without a durability guarantee if staging fails rather than dropping it.
+func (s Scaler[T, U]) stage(ctx context.Context, v T) staged[T] {
+	if s.Checkpoint == nil {
+		return staged[T]{value: v}
+	}
+
+	token, err := s.Checkpoint.Stage(ctx, v)
+	if err != nil {
+		return staged[T]{value: v}
+	}
+
+	return staged[T]{value: v, token: token}
+}
+
+// MemCheckpointer is an in-memory Checkpointer, primarily useful for tests.
+// It is not durable across process restarts: Recover only replays items
+// staged earlier in the same MemCheckpointer's lifetime. The zero value is
+// not usable; use NewMemCheckpointer.
+type MemCheckpointer[T any] struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]T
+}
+
+// NewMemCheckpointer returns a ready-to-use MemCheckpointer.
+func NewMemCheckpointer[T any]() *MemCheckpointer[T] {
+	return &MemCheckpointer[T]{pending: make(map[uint64]T)}
+}
+
+func (c *MemCheckpointer[T]) Stage(_ context.Context, t T) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.next++
+	token := c.next
+	c.pending[token] = t
+
+	return token, nil
+}
+
+func (c *MemCheckpointer[T]) Ack(_ context.Context, token any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, token.(uint64))
+
+	return nil
+}
+
+func (c *MemCheckpointer[T]) Recover(ctx context.Context) (<-chan Recovered[T], error) {
+	c.mu.Lock()
+	pending := make(map[uint64]T, len(c.pending))
+	for k, v := range c.pending {
+		pending[k] = v
+	}
+	c.mu.Unlock()
+
+	out := make(chan Recovered[T])
+
+	go func() {
+		defer close(out)
+
+		for token, v := range pending {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- Recovered[T]{Value: v, Token: token}:
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// FileCheckpointer is a filesystem-backed Checkpointer. Each staged item is
+// gob-encoded to its own file under Dir; Ack removes the file. Recover reads
+// every remaining file in Dir, so any file left behind by a crash before it
+// could be acked is replayed. The zero value is not usable; use
+// NewFileCheckpointer.
+//
+// NOTE: token numbering resumes from the highest-numbered file already in
+// Dir (see resumeNext), rather than restarting from zero on every process
+// start: restarting from zero could otherwise mint a token that collides
+// with, and os.Create-truncates, an un-acked file from a previous run that
+// hasn't been recovered yet.
+type FileCheckpointer[T any] struct {
+	Dir string
+
+	mu        sync.Mutex
+	next      uint64
+	resumedAt sync.Once
+}
+
+// NewFileCheckpointer returns a FileCheckpointer that stores staged items
+// under dir.
+func NewFileCheckpointer[T any](dir string) *FileCheckpointer[T] {
+	return &FileCheckpointer[T]{Dir: dir}
+}
+
+func (c *FileCheckpointer[T]) path(token uint64) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%020d.chk", token))
+}
+
+// resumeNext sets c.next to the highest token already present in Dir, the
+// first time it's called, so freshly minted tokens can't collide with
+// existing, not-yet-recovered files. A missing Dir just leaves next at zero,
+// matching Stage creating it on demand.
+func (c *FileCheckpointer[T]) resumeNext() {
+	c.resumedAt.Do(func() {
+		entries, err := os.ReadDir(c.Dir)
+		if err != nil {
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".chk" {
+				continue
+			}
+
+			token, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".chk"), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			if token > c.next {
+				c.next = token
+			}
+		}
+	})
+}
+
+func (c *FileCheckpointer[T]) Stage(_ context.Context, t T) (any, error) {
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	c.resumeNext()
+
+	c.mu.Lock()
+	c.next++
+	token := c.next
+	c.mu.Unlock()
+
+	f, err := os.Create(c.path(token))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewEncoder(f).Encode(t); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (c *FileCheckpointer[T]) Ack(_ context.Context, token any) error {
+	err := os.Remove(c.path(token.(uint64)))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (c *FileCheckpointer[T]) Recover(ctx context.Context) (<-chan Recovered[T], error) {
+	c.resumeNext()
+
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			out := make(chan Recovered[T])
+			close(out)
+
+			return out, nil
+		}
+
+		return nil, err
+	}
+
+	out := make(chan Recovered[T])
+
+	go func() {
+		defer close(out)
+
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".chk" {
+				continue
+			}
+
+			token, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".chk"), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			f, err := os.Open(filepath.Join(c.Dir, entry.Name()))
+			if err != nil {
+				continue
+			}
+
+			var t T
+			err = gob.NewDecoder(f).Decode(&t)
+			f.Close()
+
+			if err != nil {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- Recovered[T]{Value: t, Token: token}:
+			}
+		}
+	}()
+
+	return out, nil
+}
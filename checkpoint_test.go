@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestMemCheckpointerRecoverReusesToken(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemCheckpointer[int]()
+
+	token, err := c.Stage(ctx, 42)
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+
+	recovered, err := c.Recover(ctx)
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	rv, ok := <-recovered
+	if !ok {
+		t.Fatal("Recover returned no items, want 1")
+	}
+
+	if rv.Value != 42 || rv.Token != token {
+		t.Fatalf("Recover = %+v, want {Value:42 Token:%v}", rv, token)
+	}
+
+	if err := c.Ack(ctx, rv.Token); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	recovered, err = c.Recover(ctx)
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	if _, ok := <-recovered; ok {
+		t.Fatal("Recover returned an item after it was acked with the recovered token")
+	}
+}
+
+func TestFileCheckpointerRecoverResumesTokens(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	first := NewFileCheckpointer[string](dir)
+
+	oldToken, err := first.Stage(ctx, "un-acked")
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+
+	// A fresh FileCheckpointer pointed at the same Dir simulates a restart
+	// after a crash: its own token counter starts at zero.
+	second := NewFileCheckpointer[string](dir)
+
+	recovered, err := second.Recover(ctx)
+	if err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	rv, ok := <-recovered
+	if !ok {
+		t.Fatal("Recover returned no items, want 1")
+	}
+
+	if rv.Value != "un-acked" || rv.Token != oldToken {
+		t.Fatalf("Recover = %+v, want {Value:un-acked Token:%v}", rv, oldToken)
+	}
+
+	// Staging a brand-new item must not mint a token that collides with,
+	// and so os.Create-truncates, the still-un-acked file above.
+	newToken, err := second.Stage(ctx, "new")
+	if err != nil {
+		t.Fatalf("Stage: %v", err)
+	}
+
+	if newToken == oldToken {
+		t.Fatalf("new token %v collided with recovered, un-acked token %v", newToken, oldToken)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("got %d .chk files, want 2 (un-acked original plus new)", len(entries))
+	}
+
+	if err := second.Ack(ctx, rv.Token); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	if _, err := os.Stat(second.path(oldToken.(uint64))); !os.IsNotExist(err) {
+		t.Fatalf("recovered file still exists after Ack with its original token: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package stream
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Observer receives lifecycle notifications from a Scaler as it runs. Every
+// field is optional; a nil callback is simply not invoked. None of the
+// callbacks may block, since all of them are invoked from the Scaler's
+// internal goroutines.
+type Observer struct {
+	// OnSpawn is called immediately after a new layer2 routine is started.
+	OnSpawn func()
+
+	// OnRetire is called immediately after a layer2 routine exits, whether
+	// because the context was canceled, its Life elapsed, or its incoming
+	// channel was closed.
+	OnRetire func()
+
+	// OnItem is called after Fn returns for an item, with how long Fn took
+	// and whether the result was sent to out. In batching mode it is called
+	// once per BatchInterceptFunc call, for the whole batch.
+	OnItem func(d time.Duration, sent bool)
+
+	// OnPanic is called with the recovered value and a stack trace whenever
+	// Exec or layer2 recovers from a panic raised by Fn.
+	OnPanic func(recovered any, stack []byte)
+
+	// OnBackpressure is called whenever MaxRoutines or Rate causes the
+	// Scaler to hold off spawning a new layer2 or processing an item.
+	OnBackpressure func(error)
+}
+
+func (o Observer) spawn() {
+	if o.OnSpawn != nil {
+		o.OnSpawn()
+	}
+}
+
+func (o Observer) retire() {
+	if o.OnRetire != nil {
+		o.OnRetire()
+	}
+}
+
+func (o Observer) item(d time.Duration, sent bool) {
+	if o.OnItem != nil {
+		o.OnItem(d, sent)
+	}
+}
+
+func (o Observer) panicked(recovered any, stack []byte) {
+	if o.OnPanic != nil {
+		o.OnPanic(recovered, stack)
+	}
+}
+
+func (o Observer) backpressure(err error) {
+	if o.OnBackpressure != nil {
+		o.OnBackpressure(err)
+	}
+}
+
+// NewLogObserver returns an Observer that writes each event to logger via the
+// standard log package. A nil logger defaults to log.Default().
+func NewLogObserver(logger *log.Logger) Observer {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return Observer{
+		OnSpawn:  func() { logger.Println("stream: layer2 spawned") },
+		OnRetire: func() { logger.Println("stream: layer2 retired") },
+		OnItem: func(d time.Duration, sent bool) {
+			logger.Printf("stream: item processed in %s (sent=%t)", d, sent)
+		},
+		OnPanic: func(recovered any, stack []byte) {
+			logger.Printf("stream: recovered panic: %v\n%s", recovered, stack)
+		},
+		OnBackpressure: func(err error) {
+			logger.Printf("stream: %v", err)
+		},
+	}
+}
+
+// PrometheusObserver holds the metrics recorded by NewPrometheusObserver. Any
+// metric left nil is simply skipped, so callers may wire up only the ones
+// they care about.
+type PrometheusObserver struct {
+	Spawned      prometheus.Counter
+	Retired      prometheus.Counter
+	ItemDuration prometheus.Histogram
+	ItemsSent    prometheus.Counter
+	ItemsDropped prometheus.Counter
+	Panics       prometheus.Counter
+	Backpressure prometheus.Counter
+}
+
+// NewPrometheusObserver returns an Observer that records Scaler events onto
+// the metrics in m.
+func NewPrometheusObserver(m PrometheusObserver) Observer {
+	return Observer{
+		OnSpawn: func() {
+			if m.Spawned != nil {
+				m.Spawned.Inc()
+			}
+		},
+		OnRetire: func() {
+			if m.Retired != nil {
+				m.Retired.Inc()
+			}
+		},
+		OnItem: func(d time.Duration, sent bool) {
+			if m.ItemDuration != nil {
+				m.ItemDuration.Observe(d.Seconds())
+			}
+
+			if sent {
+				if m.ItemsSent != nil {
+					m.ItemsSent.Inc()
+				}
+			} else if m.ItemsDropped != nil {
+				m.ItemsDropped.Inc()
+			}
+		},
+		OnPanic: func(recovered any, stack []byte) {
+			if m.Panics != nil {
+				m.Panics.Inc()
+			}
+		},
+		OnBackpressure: func(err error) {
+			if m.Backpressure != nil {
+				m.Backpressure.Inc()
+			}
+		},
+	}
+}
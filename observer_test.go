@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScalerObserverHooks(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		spawns  int
+		retires int
+		items   []bool
+		panics  int
+	)
+
+	obs := Observer{
+		OnSpawn: func() {
+			mu.Lock()
+			spawns++
+			mu.Unlock()
+		},
+		OnRetire: func() {
+			mu.Lock()
+			retires++
+			mu.Unlock()
+		},
+		OnItem: func(_ time.Duration, sent bool) {
+			mu.Lock()
+			items = append(items, sent)
+			mu.Unlock()
+		},
+		OnPanic: func(_ any, _ []byte) {
+			mu.Lock()
+			panics++
+			mu.Unlock()
+		},
+	}
+
+	s := Scaler[int, int]{
+		Wait:     time.Millisecond,
+		Life:     20 * time.Millisecond,
+		Observer: obs,
+		Fn: func(_ context.Context, v int) (int, bool) {
+			if v == -1 {
+				panic("boom")
+			}
+
+			return v, v%2 == 0
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan int)
+	out, err := s.Exec(ctx, in)
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	go func() {
+		in <- 2  // sent
+		in <- 3  // filtered, Fn returns sent=false
+		in <- -1 // panics inside its own layer2 routine
+	}()
+
+	// Only v=2 is ever delivered: v=3 is filtered and v=-1 panics before
+	// reaching out.
+	select {
+	case v := <-out:
+		if v != 2 {
+			t.Fatalf("out = %d, want 2", v)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for output")
+	}
+
+	// Give the panicking routine, and any now-idle ones, time to retire.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if spawns == 0 {
+		t.Error("OnSpawn was never called")
+	}
+
+	if retires == 0 {
+		t.Error("OnRetire was never called")
+	}
+
+	if len(items) < 2 {
+		t.Errorf("OnItem called %d times, want at least 2 (for v=2 and v=3)", len(items))
+	}
+
+	if panics != 1 {
+		t.Errorf("OnPanic called %d times, want 1 (for v=-1)", panics)
+	}
+}
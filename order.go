@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"context"
+	"sync"
+)
+
+// orderedValue pairs a value produced by a layer2 routine with the sequence
+// number Exec assigned to its input, and whether it should be sent at all.
+// It lets the reorder stage advance past an item even when Fn chose not to
+// send anything for it. token is the staged item's Checkpoint token (nil if
+// none), carried through so the reorder stage can ack it itself once the
+// value has actually been delivered to out, rather than layer2 acking it
+// while it may still be sitting unread in the reorder buffer.
+type orderedValue[U any] struct {
+	seq   uint64
+	value U
+	send  bool
+	token any
+}
+
+// reorder restores input order across concurrently-running layer2 routines
+// when Scaler.PreserveOrder is set. Out-of-order results are buffered by
+// sequence number until the ones preceding them arrive, then released to out
+// in order. maxWindow, if non-zero, bounds how many sequence numbers may be
+// outstanding at once; submit uses wait to block ingestion of new items once
+// that bound is reached, rather than letting the buffer grow unbounded.
+type reorder[U any] struct {
+	maxWindow uint64
+
+	mu       sync.Mutex
+	next     uint64
+	pending  map[uint64]orderedValue[U]
+	advanced chan struct{}
+}
+
+// newReorder returns a ready-to-use reorder. maxWindow <= 0 means unbounded.
+func newReorder[U any](maxWindow int) *reorder[U] {
+	r := &reorder[U]{
+		pending:  make(map[uint64]orderedValue[U]),
+		advanced: make(chan struct{}),
+	}
+
+	if maxWindow > 0 {
+		r.maxWindow = uint64(maxWindow)
+	}
+
+	return r
+}
+
+// wait blocks until fewer than maxWindow sequence numbers are outstanding
+// ahead of the one about to be issued, or ctx is canceled.
+func (r *reorder[U]) wait(ctx context.Context, seq uint64) {
+	if r.maxWindow == 0 {
+		return
+	}
+
+	for {
+		r.mu.Lock()
+		if seq-r.next < r.maxWindow {
+			r.mu.Unlock()
+			return
+		}
+		advanced := r.advanced
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-advanced:
+		}
+	}
+}
+
+// run drains merged, a channel shared by every layer2 routine, and releases
+// values to out strictly in sequence order, acking each one with ack once it
+// has actually been delivered. It returns once merged is closed or ctx is
+// canceled.
+func (r *reorder[U]) run(ctx context.Context, merged <-chan orderedValue[U], out chan<- U, ack func(context.Context, any)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ov, ok := <-merged:
+			if !ok {
+				return
+			}
+
+			r.mu.Lock()
+			r.pending[ov.seq] = ov
+
+			var ready []orderedValue[U]
+			for {
+				v, found := r.pending[r.next]
+				if !found {
+					break
+				}
+
+				delete(r.pending, r.next)
+				r.next++
+				ready = append(ready, v)
+			}
+
+			advanced := r.advanced
+			if len(ready) > 0 {
+				r.advanced = make(chan struct{})
+			}
+			r.mu.Unlock()
+
+			if len(ready) > 0 {
+				close(advanced)
+			}
+
+			for _, v := range ready {
+				// An item layer2 chose not to send was still fully
+				// processed: ack it here too, rather than only the ones
+				// actually delivered to out, so Checkpoint doesn't replay
+				// it forever.
+				if !v.send {
+					ack(ctx, v.token)
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case out <- v.value:
+					ack(ctx, v.token)
+				}
+			}
+		}
+	}
+}
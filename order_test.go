@@ -0,0 +1,167 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReorderRestoresSequenceOrder(t *testing.T) {
+	ctx := context.Background()
+	ro := newReorder[string](0)
+
+	merged := make(chan orderedValue[string])
+	out := make(chan string)
+
+	var acked []any
+	ack := func(_ context.Context, token any) {
+		acked = append(acked, token)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ro.run(ctx, merged, out, ack)
+		close(done)
+	}()
+
+	go func() {
+		merged <- orderedValue[string]{seq: 2, value: "c", send: true, token: "t2"}
+		merged <- orderedValue[string]{seq: 0, value: "a", send: true, token: "t0"}
+		merged <- orderedValue[string]{seq: 1, value: "b", send: true, token: "t1"}
+		close(merged)
+	}()
+
+	want := []string{"a", "b", "c"}
+	for i, w := range want {
+		select {
+		case got := <-out:
+			if got != w {
+				t.Fatalf("out[%d] = %q, want %q", i, got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for out[%d]", i)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run did not return after merged was closed")
+	}
+
+	wantAcked := []any{"t0", "t1", "t2"}
+	if len(acked) != len(wantAcked) {
+		t.Fatalf("acked = %v, want %v", acked, wantAcked)
+	}
+
+	for i := range wantAcked {
+		if acked[i] != wantAcked[i] {
+			t.Fatalf("acked = %v, want %v", acked, wantAcked)
+		}
+	}
+}
+
+func TestReorderSkipsUnsentValuesButStillAcksThem(t *testing.T) {
+	ctx := context.Background()
+	ro := newReorder[string](0)
+
+	merged := make(chan orderedValue[string])
+	out := make(chan string)
+
+	var acked []any
+	ack := func(_ context.Context, token any) {
+		acked = append(acked, token)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ro.run(ctx, merged, out, ack)
+		close(done)
+	}()
+
+	go func() {
+		merged <- orderedValue[string]{seq: 0, value: "skip", send: false, token: "t0"}
+		merged <- orderedValue[string]{seq: 1, value: "b", send: true, token: "t1"}
+		close(merged)
+	}()
+
+	select {
+	case got := <-out:
+		if got != "b" {
+			t.Fatalf("out = %q, want %q", got, "b")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for out")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run did not return after merged was closed")
+	}
+
+	// seq 0 was never sent to out, but it was fully processed by layer2, so
+	// it must still be acked -- otherwise a Checkpointer would replay it
+	// forever.
+	want := []any{"t0", "t1"}
+	if len(acked) != len(want) {
+		t.Fatalf("acked = %v, want %v", acked, want)
+	}
+
+	for i := range want {
+		if acked[i] != want[i] {
+			t.Fatalf("acked = %v, want %v", acked, want)
+		}
+	}
+}
+
+func TestReorderWaitBlocksUntilWindowAdvances(t *testing.T) {
+	ctx := context.Background()
+	ro := newReorder[string](1)
+
+	merged := make(chan orderedValue[string])
+	out := make(chan string)
+	ack := func(context.Context, any) {}
+
+	done := make(chan struct{})
+	go func() {
+		ro.run(ctx, merged, out, ack)
+		close(done)
+	}()
+
+	// seq 0 has nothing outstanding ahead of it, so it's within the window
+	// of 1; seq 1 is not, until seq 0 has been consumed by run.
+	ro.wait(ctx, 0)
+
+	waited := make(chan struct{})
+	go func() {
+		ro.wait(ctx, 1)
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("wait returned before the window advanced")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	merged <- orderedValue[string]{seq: 0, value: "a", send: true}
+
+	if got := <-out; got != "a" {
+		t.Fatalf("out = %q, want %q", got, "a")
+	}
+
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after the window advanced")
+	}
+
+	close(merged)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run did not return after merged was closed")
+	}
+}
@@ -0,0 +1,142 @@
+package stream
+
+import "time"
+
+// ScaleSample summarizes a Scaler's recent activity, taken once per
+// SampleInterval and handed to the configured ScalePolicy.
+type ScaleSample struct {
+	// InFlight is the number of layer2 routines currently alive.
+	InFlight int
+
+	// AvgLatency is the average duration of Fn (or BatchInterceptFunc)
+	// calls completed during the sample window.
+	AvgLatency time.Duration
+
+	// Throughput is the number of Fn (or BatchInterceptFunc) calls
+	// completed per second during the sample window; in batching mode a
+	// whole batch counts once.
+	Throughput float64
+
+	// BlockRatio is the fraction, in [0,1], of items submitted during the
+	// sample window that could not be handed to an already-waiting layer2
+	// routine, meaning every live routine was busy. A submission still
+	// waiting when a sample is taken is counted again in the next window.
+	BlockRatio float64
+
+	// Goroutines is runtime.NumGoroutine() at the time the sample was
+	// taken, a coarse proxy for CPU/scheduler pressure.
+	Goroutines int
+}
+
+// ScalePolicy decides how many layer2 routines a Scaler should run. Target
+// is consulted once per SampleInterval; Exec spawns routines until the live
+// count reaches the returned target, but never forcibly retires a routine
+// above it, relying instead on Life to let idle routines exit naturally.
+type ScalePolicy interface {
+	Target(sample ScaleSample) int
+}
+
+// FixedTickerPolicy reproduces the Scaler's original fixed-interval scaling
+// behavior: grow by one routine per sample while submissions are blocking,
+// and otherwise hold steady. It is the default ScalePolicy when none is
+// configured.
+type FixedTickerPolicy struct{}
+
+func (FixedTickerPolicy) Target(sample ScaleSample) int {
+	if sample.BlockRatio > 0 {
+		return sample.InFlight + 1
+	}
+
+	return sample.InFlight
+}
+
+// AIMDPolicy is a ScalePolicy implementing additive-increase,
+// multiplicative-decrease: it grows the worker count by Step per sample
+// while send-blocks occur, and once BlockRatio has been zero for
+// IdleSamples consecutive samples, halves the target to shrink back down.
+type AIMDPolicy struct {
+	// Step is how many routines to add per sample while blocked. Defaults
+	// to 1 if less than 1.
+	Step int
+
+	// IdleSamples is how many consecutive idle samples (BlockRatio == 0)
+	// must be observed before shrinking. Defaults to 1 if less than 1.
+	IdleSamples int
+
+	// Max caps the returned target. Zero means unbounded.
+	Max int
+
+	idle int
+}
+
+func (p *AIMDPolicy) Target(sample ScaleSample) int {
+	if sample.BlockRatio > 0 {
+		p.idle = 0
+
+		step := p.Step
+		if step < 1 {
+			step = 1
+		}
+
+		return p.clamp(sample.InFlight + step)
+	}
+
+	p.idle++
+
+	idleSamples := p.IdleSamples
+	if idleSamples < 1 {
+		idleSamples = 1
+	}
+
+	if p.idle < idleSamples {
+		return p.clamp(sample.InFlight)
+	}
+
+	p.idle = 0
+
+	return p.clamp(sample.InFlight / 2)
+}
+
+func (p *AIMDPolicy) clamp(target int) int {
+	if target < 0 {
+		target = 0
+	}
+
+	if p.Max > 0 && target > p.Max {
+		target = p.Max
+	}
+
+	return target
+}
+
+// LittlesLawPolicy is a ScalePolicy that targets a worker count derived from
+// Little's Law (L = λW): given the observed throughput (λ) and average
+// latency (W) it estimates how many concurrent workers are needed to
+// sustain that load, then adds TargetQueueDepth workers of headroom so that
+// roughly that many items can be held in flight without blocking.
+type LittlesLawPolicy struct {
+	// TargetQueueDepth is the additional in-flight headroom, beyond what's
+	// needed to merely keep up, to hold against bursts.
+	TargetQueueDepth int
+
+	// Max caps the returned target. Zero means unbounded.
+	Max int
+}
+
+func (p LittlesLawPolicy) Target(sample ScaleSample) int {
+	want := sample.Throughput * sample.AvgLatency.Seconds()
+	if p.TargetQueueDepth > 0 {
+		want += float64(p.TargetQueueDepth)
+	}
+
+	target := int(want + 0.999999) // ceil, want is always >= 0
+	if target < 1 {
+		target = 1
+	}
+
+	if p.Max > 0 && target > p.Max {
+		target = p.Max
+	}
+
+	return target
+}
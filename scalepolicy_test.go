@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAIMDPolicyTarget(t *testing.T) {
+	p := &AIMDPolicy{Step: 2, IdleSamples: 2, Max: 10}
+
+	// Blocked: grow by Step.
+	if got := p.Target(ScaleSample{InFlight: 3, BlockRatio: 0.5}); got != 5 {
+		t.Fatalf("blocked Target = %d, want 5", got)
+	}
+
+	// Idle, but fewer than IdleSamples consecutive idle samples: hold.
+	if got := p.Target(ScaleSample{InFlight: 5, BlockRatio: 0}); got != 5 {
+		t.Fatalf("first idle sample Target = %d, want 5 (hold)", got)
+	}
+
+	// Second consecutive idle sample reaches IdleSamples: halve.
+	if got := p.Target(ScaleSample{InFlight: 5, BlockRatio: 0}); got != 2 {
+		t.Fatalf("second idle sample Target = %d, want 2 (halved)", got)
+	}
+
+	// A block in between resets the idle streak.
+	p = &AIMDPolicy{Step: 1, IdleSamples: 2}
+	p.Target(ScaleSample{InFlight: 4, BlockRatio: 0})
+	p.Target(ScaleSample{InFlight: 4, BlockRatio: 1})
+	if got := p.Target(ScaleSample{InFlight: 4, BlockRatio: 0}); got != 4 {
+		t.Fatalf("idle streak not reset by intervening block: Target = %d, want 4 (hold)", got)
+	}
+
+	// Max clamps growth.
+	p = &AIMDPolicy{Step: 100, Max: 5}
+	if got := p.Target(ScaleSample{InFlight: 3, BlockRatio: 1}); got != 5 {
+		t.Fatalf("Max-clamped Target = %d, want 5", got)
+	}
+}
+
+func TestLittlesLawPolicyTarget(t *testing.T) {
+	tests := map[string]struct {
+		policy LittlesLawPolicy
+		sample ScaleSample
+		want   int
+	}{
+		"no load floors at 1": {
+			sample: ScaleSample{Throughput: 0, AvgLatency: 0},
+			want:   1,
+		},
+		"throughput times latency, rounded up": {
+			// 10 items/sec * 250ms = 2.5 concurrent workers needed.
+			sample: ScaleSample{Throughput: 10, AvgLatency: 250 * time.Millisecond},
+			want:   3,
+		},
+		"target queue depth adds headroom": {
+			policy: LittlesLawPolicy{TargetQueueDepth: 4},
+			sample: ScaleSample{Throughput: 10, AvgLatency: 100 * time.Millisecond},
+			want:   5,
+		},
+		"max clamps the result": {
+			policy: LittlesLawPolicy{Max: 2},
+			sample: ScaleSample{Throughput: 100, AvgLatency: time.Second},
+			want:   2,
+		},
+	}
+
+	for name, test := range tests {
+		test := test
+
+		t.Run(name, func(t *testing.T) {
+			if got := test.policy.Target(test.sample); got != test.want {
+				t.Fatalf("Target(%+v) = %d, want %d", test.sample, got, test.want)
+			}
+		})
+	}
+}
@@ -2,11 +2,22 @@ package stream
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
+// ErrBackpressure is passed to a Scaler's Observer.OnBackpressure (if set)
+// whenever the Scaler declines to immediately scale up or process an item
+// because MaxRoutines or Rate has been reached. It is not returned from Exec.
+var ErrBackpressure = errors.New("stream: backpressure applied")
+
 // Scaler implements generic auto-scaling logic which starts with a net-zero
 // set of processing routines (with the exception of the channel listener) and
 // then scales up and down based on the CPU contention of a system and the speed
@@ -20,21 +31,169 @@ import (
 // and InterceptFunc fields. These fields are what configure the functionality
 // of the Scaler.
 //
-// NOTE: Fn is REQUIRED!
+// MaxRoutines and Rate/Burst are optional and, when set, bound how far the
+// Scaler will scale up: MaxRoutines caps the number of concurrently running
+// layer2 routines, and Rate/Burst cap how quickly new routines are spawned
+// and how quickly the routines, taken together, may hand items to Fn. Observer, if set, is
+// notified whenever either of these limits causes the Scaler to hold off.
+//
+// BatchInterceptFunc, BatchSize, and BatchWait are an alternative to Fn that
+// invoke the configured function once per accumulated batch of items rather
+// than once per item; see their doc comments for details.
+//
+// PreserveOrder, when set, makes Exec emit results in the same order their
+// inputs were read from in, despite being processed by multiple concurrent
+// layer2 routines; see its doc comment for details.
+//
+// NOTE: Either Fn or BatchInterceptFunc is REQUIRED!
 //
 // After creating the Scaler instance and configuring it, call the Exec method
 // passing the appropriate context and input channel.
 //
-// Internally the Scaler implementation will wait for data on the incoming
-// channel and attempt to send it to a layer2 channel. If the layer2 channel
-// is blocking and the Wait time has been reached, then the Scaler will spawn
-// a new layer2 which will increase throughput for the Scaler, and Scaler
-// will attempt to send the data to the layer2 channel once more. This process
-// will repeat until a successful send occurs. (This should only loop twice)
+// Internally the Scaler implementation waits for data on the incoming
+// channel and hands it to a layer2 channel shared by every live layer2
+// routine. Separately, once per SampleInterval, Policy is consulted with a
+// ScaleSample describing recent activity (in-flight count, average Fn
+// latency, send-block ratio, and goroutine count) and returns the target
+// number of layer2 routines; the Scaler spawns routines until that target is
+// reached. Policy defaults to FixedTickerPolicy, which reproduces the
+// original behavior of growing by one routine per sample while sends are
+// blocking. Routines are never forcibly retired above the target: each one
+// exits on its own once it has been idle for Life.
 type Scaler[T, U any] struct {
 	Wait time.Duration
 	Life time.Duration
 	Fn   InterceptFunc[T, U]
+
+	// MaxRoutines caps the number of layer2 routines that may be alive at
+	// once, clamping whatever target Policy returns. Zero (the default)
+	// means unbounded.
+	MaxRoutines int
+
+	// Rate and Burst, when Rate is non-zero, bound how quickly Exec may
+	// spawn new layer2 routines and, independently, how quickly the layer2
+	// routines together may hand items to Fn (one limit shared by all of
+	// them, not one per routine). Spawning and per-item processing each
+	// get their own golang.org/x/time/rate.Limiter built from this
+	// Rate/Burst rather than sharing a single bucket, so spawn activity
+	// can't eat into, and silently reduce, the per-item throughput this is
+	// configured to allow. This guards against runaway goroutine growth
+	// and downstream overload under bursty input.
+	Rate  rate.Limit
+	Burst int
+
+	// Observer, if set, receives lifecycle notifications (spawn, retire,
+	// per-item duration, recovered panics, and backpressure) as the Scaler
+	// runs. See the Observer type for details.
+	Observer Observer
+
+	// BatchSize, BatchWait, and BatchInterceptFunc, when BatchInterceptFunc
+	// is set, switch layer2 into batching mode: instead of invoking Fn once
+	// per item, layer2 accumulates up to BatchSize items (or until
+	// BatchWait has elapsed since the first item of the batch arrived) and
+	// invokes BatchInterceptFunc once for the whole batch. Fn is ignored in
+	// this mode. BatchSize defaults to 1 if unset.
+	BatchSize          int
+	BatchWait          time.Duration
+	BatchInterceptFunc BatchInterceptFunc[T, U]
+
+	// Checkpoint, if set, turns the Scaler into a crash-safe worker: every
+	// item is staged with Checkpoint before being handed to a layer2
+	// routine, and acked only once it (or, in batching mode, its batch) has
+	// been fully processed and either delivered to out or, when Fn (or
+	// BatchInterceptFunc) returned send=false, dropped. On startup, Exec replays
+	// any previously staged but un-acked items via Checkpoint.Recover
+	// before reading from in.
+	Checkpoint Checkpointer[T]
+
+	// Policy decides how many layer2 routines should be alive, re-evaluated
+	// every SampleInterval. Defaults to FixedTickerPolicy, which reproduces
+	// the original fixed-interval scale-up-while-blocked behavior.
+	Policy ScalePolicy
+
+	// SampleInterval is how often Policy is consulted. Defaults to Wait.
+	SampleInterval time.Duration
+
+	// PreserveOrder, when true, tags each item read from in with a
+	// monotonic sequence number and reorders results from the (possibly
+	// many, concurrently-running) layer2 routines back into input order
+	// before they reach out. MaxReorderWindow bounds how many sequence
+	// numbers may be outstanding at once; once reached, Exec stops reading
+	// further items from in until the head of the sequence arrives, so
+	// nothing is dropped. Zero means unbounded. PreserveOrder has no effect
+	// in batching mode.
+	PreserveOrder    bool
+	MaxReorderWindow int
+
+	routines int32
+
+	// stats holds the counters accumulated since the last call to sample;
+	// see sample. It is a pointer, allocated once by Exec, because Scaler's
+	// methods all take Scaler by value: layer2 and layer2Batch run with
+	// their own copy of s, so a plain int64 field mutated there would never
+	// be visible to the copy of s that Exec's own goroutine reads from.
+	// Routing the counters through a shared pointer instead means every
+	// copy of s derived from Exec's still mutates the same memory.
+	stats *scalerStats
+}
+
+// scalerStats holds the mutable counters Scaler accumulates between calls to
+// sample. See the stats field doc comment for why it's a pointer.
+type scalerStats struct {
+	itemCount    int64
+	latencyNanos int64
+	submitCount  int64
+	blockedCount int64
+}
+
+// policy returns s.Policy, defaulting to FixedTickerPolicy if unset.
+func (s Scaler[T, U]) policy() ScalePolicy {
+	if s.Policy == nil {
+		return FixedTickerPolicy{}
+	}
+
+	return s.Policy
+}
+
+// sample computes a ScaleSample from the counters accumulated since the
+// previous call (or since Exec started, for the first call) over the given
+// window, and resets those counters.
+func (s Scaler[T, U]) sample(window time.Duration) ScaleSample {
+	items := atomic.SwapInt64(&s.stats.itemCount, 0)
+	latency := atomic.SwapInt64(&s.stats.latencyNanos, 0)
+	submits := atomic.SwapInt64(&s.stats.submitCount, 0)
+	blocked := atomic.SwapInt64(&s.stats.blockedCount, 0)
+
+	var avgLatency time.Duration
+	if items > 0 {
+		avgLatency = time.Duration(latency / items)
+	}
+
+	var blockRatio float64
+	if submits > 0 {
+		blockRatio = float64(blocked) / float64(submits)
+	}
+
+	var throughput float64
+	if window > 0 {
+		throughput = float64(items) / window.Seconds()
+	}
+
+	return ScaleSample{
+		InFlight:   int(atomic.LoadInt32(&s.routines)),
+		AvgLatency: avgLatency,
+		Throughput: throughput,
+		BlockRatio: blockRatio,
+		Goroutines: runtime.NumGoroutine(),
+	}
+}
+
+// recordItem updates the counters used for sampling and reports the item to
+// Observer.
+func (s Scaler[T, U]) recordItem(d time.Duration, sent bool) {
+	atomic.AddInt64(&s.stats.itemCount, 1)
+	atomic.AddInt64(&s.stats.latencyNanos, int64(d))
+	s.Observer.item(d, sent)
 }
 
 // Exec starts the internal Scaler routine (the first layer of processing) and
@@ -43,14 +202,19 @@ type Scaler[T, U any] struct {
 func (s Scaler[T, U]) Exec(ctx context.Context, in <-chan T) (<-chan U, error) {
 	ctx = _ctx(ctx)
 
-	// Fn is REQUIRED!
-	if s.Fn == nil {
+	// Fn is REQUIRED, unless BatchInterceptFunc has been configured instead.
+	if s.Fn == nil && s.BatchInterceptFunc == nil {
 		return nil, fmt.Errorf("invalid <nil> InterceptFunc")
 	}
 
 	// Create outbound channel
 	out := make(chan U)
 
+	// Every copy of s derived from this one (layer2, layer2Batch, the
+	// closures below) shares this allocation; see the stats field doc
+	// comment.
+	s.stats = &scalerStats{}
+
 	// nano-second precision really isn't feasible here, so this is arbitrary
 	// because the caller did not specify a wait time. This means Scaler will
 	// likely always scale up rather than waiting for an existing layer2 routine
@@ -64,10 +228,73 @@ func (s Scaler[T, U]) Exec(ctx context.Context, in <-chan T) (<-chan U, error) {
 		s.Life = time.Microsecond
 	}
 
+	// When Rate is configured, spawn decisions (here) and per-item
+	// processing (in layer2/layer2Batch) each get their own limiter, so
+	// that bursts of spawning don't consume from, and under-deliver, the
+	// budget meant for item throughput.
+	var spawnLimiter, itemLimiter *rate.Limiter
+	if s.Rate > 0 {
+		burst := s.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		spawnLimiter = rate.NewLimiter(s.Rate, burst)
+		itemLimiter = rate.NewLimiter(s.Rate, burst)
+	}
+
+	// If a Checkpointer is configured, replay anything it staged but never
+	// acked before this Exec handles any new data from in. A failure here
+	// means crash-safety can't be guaranteed, so it's returned rather than
+	// silently treated as "nothing to recover".
+	var recovered <-chan Recovered[T]
+	if s.Checkpoint != nil {
+		r, err := s.Checkpoint.Recover(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("stream: recovering checkpoint: %w", err)
+		}
+
+		recovered = r
+	}
+
+	sampleInterval := s.SampleInterval
+	if sampleInterval <= 0 {
+		sampleInterval = s.Wait
+	}
+
+	policy := s.policy()
+
+	// PreserveOrder has no effect in batching mode, since a batch's items
+	// are no longer individually addressable once merged into a call to
+	// BatchInterceptFunc.
+	preserveOrder := s.PreserveOrder && s.BatchInterceptFunc == nil
+
+	var ro *reorder[U]
+	var merged chan orderedValue[U]
+	var roDone chan struct{}
+	if preserveOrder {
+		ro = newReorder[U](s.MaxReorderWindow)
+		merged = make(chan orderedValue[U])
+		roDone = make(chan struct{})
+
+		go func() {
+			ro.run(ctx, merged, out, s.ackToken)
+			close(roDone)
+		}()
+	}
+
 	go func() {
-		defer recover()
+		defer s.protect()
 		defer close(out)
 
+		// Once every layer2 routine has exited, let the reorder stage (if
+		// any) drain whatever it's still holding before out is closed.
+		defer func() {
+			if preserveOrder {
+				close(merged)
+				<-roDone
+			}
+		}()
+
 		wg := sync.WaitGroup{}
 		wgMu := sync.Mutex{}
 
@@ -79,43 +306,148 @@ func (s Scaler[T, U]) Exec(ctx context.Context, in <-chan T) (<-chan U, error) {
 			wgMu.Unlock()
 		}()
 
-		l2 := make(chan T)
-		ticker := time.NewTicker(s.Wait)
-		defer ticker.Stop()
+		l2 := make(chan staged[T])
+
+		// spawn starts a new layer2 routine, bumping s.routines for the
+		// duration of its life.
+		spawn := func() {
+			atomic.AddInt32(&s.routines, 1)
+
+			wgMu.Lock()
+			wg.Add(1)
+			wgMu.Unlock()
+
+			go func() {
+				defer wg.Done()
+				defer atomic.AddInt32(&s.routines, -1)
+
+				s.Observer.spawn()
+
+				switch {
+				case s.BatchInterceptFunc != nil:
+					Pipe(ctx, s.layer2Batch(ctx, l2, itemLimiter), out)
+				case preserveOrder:
+					// layer2 delivers results to merged instead of its own
+					// returned channel in this mode; nothing to Pipe, but
+					// wait for that channel to close so this routine lives
+					// exactly as long as the layer2 it started.
+					for range s.layer2(ctx, l2, itemLimiter, merged) {
+					}
+				default:
+					Pipe(ctx, s.layer2(ctx, l2, itemLimiter, nil), out)
+				}
+			}()
+		}
+
+		// scale re-evaluates Policy against the latest sample and spawns
+		// routines until the live count reaches the target. It never
+		// forcibly retires a routine above the target; that happens
+		// naturally via Life once a routine runs out of work.
+		scale := func() {
+			sample := s.sample(sampleInterval)
+			target := policy.Target(sample)
+
+			if s.MaxRoutines > 0 && target > s.MaxRoutines {
+				target = s.MaxRoutines
+				s.backpressure()
+			}
+
+			for int(atomic.LoadInt32(&s.routines)) < target {
+				if spawnLimiter != nil && !spawnLimiter.Allow() {
+					s.backpressure()
+					break
+				}
+
+				spawn()
+			}
+		}
+
+		sampleTicker := time.NewTicker(sampleInterval)
+		defer sampleTicker.Stop()
+
+		var nextSeq uint64
+
+		// submitStaged assigns st the next sequence number (if PreserveOrder
+		// is set, blocking here if MaxReorderWindow is exceeded), counts it
+		// toward BlockRatio if no layer2 routine was immediately ready for
+		// it, and blocks until it is handed off, re-evaluating Policy on each
+		// sample tick meanwhile. Returns false if ctx was canceled.
+		submitStaged := func(st staged[T]) bool {
+			if preserveOrder {
+				st.seq = nextSeq
+				nextSeq++
+				ro.wait(ctx, st.seq)
+			}
+
+			atomic.AddInt64(&s.stats.submitCount, 1)
+
+			select {
+			case <-ctx.Done():
+				return false
+			case l2 <- st:
+				return true
+			default:
+			}
+
+			atomic.AddInt64(&s.stats.blockedCount, 1)
+
+			// Keep sampling while waiting, since only scale spawns routines.
+			// A submission still waiting when a sample is taken is counted
+			// as blocked in the next window too.
+			for {
+				select {
+				case <-ctx.Done():
+					return false
+				case <-sampleTicker.C:
+					scale()
+					atomic.AddInt64(&s.stats.submitCount, 1)
+					atomic.AddInt64(&s.stats.blockedCount, 1)
+				case l2 <- st:
+					return true
+				}
+			}
+		}
+
+		// submit stages v with Checkpoint, if configured, and hands the
+		// result to submitStaged.
+		submit := func(v T) bool {
+			return submitStaged(s.stage(ctx, v))
+		}
 
 	scaleLoop:
 		for {
+			// in is not read until every recovered item has been resubmitted.
+			inCh := in
+			if recovered != nil {
+				inCh = nil
+			}
+
 			select {
 			case <-ctx.Done():
 				return
-			case v, ok := <-in:
+			case <-sampleTicker.C:
+				scale()
+			case rv, ok := <-recovered:
 				if !ok {
-					break scaleLoop
+					recovered = nil
+					continue
 				}
 
-			l2loop:
-				for {
-					select {
-					case <-ctx.Done():
-						return
-					case <-ticker.C:
-						wgMu.Lock()
-						wg.Add(1)
-						wgMu.Unlock()
-
-						go func() {
-							defer wg.Done()
-
-							Pipe(ctx, s.layer2(ctx, l2), out)
-						}()
-					case l2 <- v:
-						break l2loop
-					}
+				// Recovered items were already staged (and given a token)
+				// by a prior run; resubmit that same token instead of
+				// staging them again, which would mint a second token for
+				// the same value and leave the original un-acked forever.
+				if !submitStaged(staged[T]{value: rv.Value, token: rv.Token}) {
+					return
+				}
+			case v, ok := <-inCh:
+				if !ok {
+					break scaleLoop
 				}
 
-				// Reset the ticker so that it does not immediately trip the
-				// case statement on loop.
-				ticker.Reset(s.Wait)
+				if !submit(v) {
+					return
+				}
 			}
 		}
 	}()
@@ -123,6 +455,20 @@ func (s Scaler[T, U]) Exec(ctx context.Context, in <-chan T) (<-chan U, error) {
 	return out, nil
 }
 
+// backpressure reports ErrBackpressure to s.Observer, if set.
+func (s Scaler[T, U]) backpressure() {
+	s.Observer.backpressure(ErrBackpressure)
+}
+
+// protect recovers from a panic in the calling goroutine, if any, reporting
+// it to s.Observer along with a stack trace. It is the replacement for a bare
+// defer recover(), which otherwise swallows the panic with no diagnostics.
+func (s Scaler[T, U]) protect() {
+	if r := recover(); r != nil {
+		s.Observer.panicked(r, debug.Stack())
+	}
+}
+
 // layer2 manages the execution of the InterceptFunc. layer2 has a life time
 // of s.Life and will exit if the context is canceled, the timer has reached
 // its life time, or the incoming channel has been closed.
@@ -133,12 +479,13 @@ func (s Scaler[T, U]) Exec(ctx context.Context, in <-chan T) (<-chan U, error) {
 // life time of the layer2, and continue to attempt another read from the in
 // channel until the in channel is closed, the context is canceled, or the
 // timer has reached its life time.
-func (s Scaler[T, U]) layer2(ctx context.Context, in <-chan T) <-chan U {
+func (s Scaler[T, U]) layer2(ctx context.Context, in <-chan staged[T], limiter *rate.Limiter, ordered chan<- orderedValue[U]) <-chan U {
 	out := make(chan U)
 
 	go func() {
-		defer recover()
+		defer s.protect()
 		defer close(out)
+		defer s.Observer.retire()
 
 		timer := time.NewTimer(s.Life)
 		defer timer.Stop()
@@ -149,24 +496,62 @@ func (s Scaler[T, U]) layer2(ctx context.Context, in <-chan T) <-chan U {
 				return
 			case <-timer.C:
 				return
-			case t, ok := <-in:
+			case st, ok := <-in:
 				if !ok {
 					return
 				}
 
-				// If the function returns false, then don't send the data
-				// but break out of the select statement to ensure the timer
-				// is reset.
+				t := st.value
+
+				// Rate also caps how quickly this routine may hand items to
+				// Fn; report backpressure and wait for the next token
+				// rather than dropping the item.
+				if limiter != nil && !limiter.Allow() {
+					s.backpressure()
+
+					if err := limiter.Wait(ctx); err != nil {
+						return
+					}
+				}
+
+				start := time.Now()
 				u, send := s.Fn(ctx, t)
+				s.recordItem(time.Since(start), send)
+
+				// When PreserveOrder is set, ordered is non-nil and every
+				// item's outcome (even a skip) is reported to it so the
+				// reorder stage can advance past it; the item's own order,
+				// and its ack, are handled there rather than here, since the
+				// item may sit in the reorder buffer well after this point.
+				if ordered != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case ordered <- orderedValue[U]{seq: st.seq, value: u, send: send, token: st.token}:
+					}
+
+					break
+				}
+
+				// If the function returns false, the item was still fully
+				// processed by Fn, just not emitted: ack it so Checkpoint
+				// doesn't replay it forever, then break out of the select
+				// statement to ensure the timer is reset.
 				if !send {
+					s.ack(ctx, st)
 					break
 				}
 
-				// Send the resulting value to the output channel
+				// Send the resulting value to the output channel, only
+				// acking the staged item once it has actually been
+				// delivered: acking any earlier (e.g. right after Fn
+				// returns) would let a Checkpointer forget an item that
+				// ctx cancellation could still cause to be dropped here.
 				select {
 				case <-ctx.Done():
 					return
 				case out <- u:
+					s.ack(ctx, st)
 				}
 			}
 
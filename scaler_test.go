@@ -0,0 +1,126 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScalerExecBasic(t *testing.T) {
+	s := Scaler[int, int]{
+		Wait: time.Millisecond,
+		Life: 20 * time.Millisecond,
+		Fn: func(_ context.Context, v int) (int, bool) {
+			return v * 2, true
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan int)
+	out, err := s.Exec(ctx, in)
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	want := []int{1, 2, 3, 4, 5}
+
+	go func() {
+		for _, v := range want {
+			in <- v
+		}
+	}()
+
+	got := make(map[int]bool, len(want))
+	for i := range want {
+		select {
+		case v := <-out:
+			got[v] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for output %d", i)
+		}
+	}
+
+	for _, v := range want {
+		if !got[v*2] {
+			t.Fatalf("missing doubled output %d in %v", v*2, got)
+		}
+	}
+}
+
+func TestScalerExecMaxRoutinesCapsConcurrency(t *testing.T) {
+	const maxRoutines = 3
+	const items = maxRoutines * 4
+
+	var (
+		mu       sync.Mutex
+		inFlight int
+		peak     int
+	)
+
+	block := make(chan struct{})
+
+	s := Scaler[int, int]{
+		Wait:        time.Millisecond,
+		Life:        50 * time.Millisecond,
+		MaxRoutines: maxRoutines,
+		Fn: func(_ context.Context, v int) (int, bool) {
+			mu.Lock()
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mu.Unlock()
+
+			<-block
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+
+			return v, true
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan int)
+	out, err := s.Exec(ctx, in)
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	go func() {
+		for i := 0; i < items; i++ {
+			select {
+			case in <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Give the Scaler time to try (and fail) to scale past MaxRoutines
+	// while every spawned routine is stuck on block.
+	time.Sleep(200 * time.Millisecond)
+	close(block)
+
+	for i := 0; i < items; i++ {
+		select {
+		case <-out:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for output %d", i)
+		}
+	}
+
+	mu.Lock()
+	got := peak
+	mu.Unlock()
+
+	if got > maxRoutines {
+		t.Fatalf("peak concurrent Fn calls = %d, want <= %d (MaxRoutines)", got, maxRoutines)
+	}
+}